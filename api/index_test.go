@@ -0,0 +1,1671 @@
+package handler
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// fakeDB stands in for the project_manager schema. Every statement is answered by the
+// handler registered for the stored function or procedure it calls, and recorded so tests
+// can check what was written.
+type fakeDB struct {
+	mu       sync.Mutex
+	handlers map[string]func(args []any) (any, error)
+	calls    []fakeCall
+}
+
+type fakeCall struct {
+	Name string
+	Args []any
+}
+
+var fakeRoutinePattern = regexp.MustCompile(`project_manager\.(\w+)`)
+
+// useFakeDB replaces the global database for the duration of a test.
+func useFakeDB(t *testing.T, handlers map[string]func(args []any) (any, error)) *fakeDB {
+	t.Helper()
+	fake := &fakeDB{handlers: handlers}
+	previous := db
+	db = sql.OpenDB(fake)
+	t.Cleanup(func() {
+		db.Close()
+		db = previous
+	})
+	return fake
+}
+
+// returns answers every call with the same result.
+func returns(result any) func([]any) (any, error) {
+	return func([]any) (any, error) { return result, nil }
+}
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) { return fakeConn{f}, nil }
+func (f *fakeDB) Driver() driver.Driver                        { return nil }
+
+func (f *fakeDB) run(query string, args []driver.Value) (any, bool, error) {
+	name := strings.Fields(query)[0]
+	if match := fakeRoutinePattern.FindStringSubmatch(query); match != nil {
+		name = match[1]
+	}
+	values := make([]any, len(args))
+	for i, arg := range args {
+		values[i] = arg
+	}
+	f.mu.Lock()
+	f.calls = append(f.calls, fakeCall{Name: name, Args: values})
+	handler, ok := f.handlers[name]
+	f.mu.Unlock()
+	if !ok {
+		return nil, false, nil
+	}
+	result, err := handler(values)
+	return result, true, err
+}
+
+// callsTo returns the recorded calls of one routine.
+func (f *fakeDB) callsTo(name string) []fakeCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var calls []fakeCall
+	for _, call := range f.calls {
+		if call.Name == name {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+type fakeConn struct{ db *fakeDB }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{c.db, query}, nil }
+func (c fakeConn) Close() error                              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)                 { return fakeTx{}, nil }
+
+// CheckNamedValue passes arguments through untouched, as pgx accepts slices and pointers.
+func (c fakeConn) CheckNamedValue(*driver.NamedValue) error { return nil }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	_, _, err := s.db.run(s.query, args)
+	return driver.RowsAffected(1), err
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	result, ok, err := s.db.run(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("fake database: no result for %q", s.query)
+	}
+	return &fakeRows{value: result}, nil
+}
+
+type fakeRows struct {
+	value any
+	done  bool
+}
+
+func (r *fakeRows) Columns() []string { return []string{"result"} }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	switch value := r.value.(type) {
+	case int:
+		dest[0] = int64(value)
+	case []byte:
+		dest[0] = string(value)
+	default:
+		dest[0] = value
+	}
+	return nil
+}
+
+// mustJSON encodes a test fixture.
+func mustJSON(t *testing.T, value any) string {
+	t.Helper()
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(encoded)
+}
+
+// serve runs one request through a router holding only handler.
+func serve(handler gin.HandlerFunc, method, target string, body io.Reader, header http.Header) *httptest.ResponseRecorder {
+	router := gin.New()
+	router.Handle(method, strings.SplitN(target, "?", 2)[0], handler)
+	request := httptest.NewRequest(method, target, body)
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// fakeMailer records sent emails and fails for the addresses in failFor.
+type fakeMailer struct {
+	sent    []EmailMessage
+	failFor []string
+}
+
+func (m *fakeMailer) Send(message EmailMessage) error {
+	if slices.Contains(m.failFor, message.To) {
+		return errors.New("mailbox unavailable")
+	}
+	m.sent = append(m.sent, message)
+	return nil
+}
+
+func useMailer(t *testing.T, sender MailSender) {
+	t.Helper()
+	previous := mailer
+	mailer = sender
+	t.Cleanup(func() { mailer = previous })
+}
+
+func cronHeader(t *testing.T) http.Header {
+	t.Setenv("CRON_SECRET", "cron-secret")
+	return http.Header{"Authorization": {"Bearer cron-secret"}}
+}
+
+func TestNotifyAppliesPreferences(t *testing.T) {
+	preferences := []map[string]any{
+		{"userId": 2, "eventType": notifyAssignment, "inApp": false, "email": true},
+		{"userId": 3, "eventType": notifyAssignment, "inApp": true, "email": false},
+	}
+	fake := useFakeDB(t, map[string]func([]any) (any, error){
+		"get_notification_preferences_of": returns(mustJSON(t, preferences)),
+		"get_email_template":              returns(nil),
+	})
+
+	actor := 1
+	notify(db, []NotificationEvent{
+		{EventType: notifyAssignment, Title: "You were assigned to work \"Login\"", ActorId: &actor, Recipients: []int{1, 2, 3, 4, 4}},
+		{EventType: notifyStateChanged, Title: "Login moved to Done", Recipients: []int{2}},
+	})
+
+	var rows []struct {
+		UserId    int    `json:"userId"`
+		EventType string `json:"eventType"`
+	}
+	calls := fake.callsTo("post_notifications")
+	if len(calls) != 1 {
+		t.Fatalf("post_notifications called %d times, want 1", len(calls))
+	}
+	if err := json.Unmarshal([]byte(calls[0].Args[0].(string)), &rows); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, row := range rows {
+		got = append(got, fmt.Sprintf("%d:%s", row.UserId, row.EventType))
+	}
+	// The actor and the user who turned in-app assignments off get nothing; user 4 once.
+	want := []string{"3:assignment", "4:assignment", "2:state_changed"}
+	if !slices.Equal(got, want) {
+		t.Errorf("in-app notifications = %v, want %v", got, want)
+	}
+
+	var emails []QueuedEmailRequest
+	calls = fake.callsTo("post_emails")
+	if len(calls) != 1 {
+		t.Fatalf("post_emails called %d times, want 1", len(calls))
+	}
+	if err := json.Unmarshal([]byte(calls[0].Args[0].(string)), &emails); err != nil {
+		t.Fatal(err)
+	}
+	var recipients []int
+	for _, email := range emails {
+		recipients = append(recipients, email.UserId)
+		if email.Subject != `You were assigned to work "Login"` {
+			t.Errorf("email subject = %q", email.Subject)
+		}
+	}
+	// State changes are never emailed; user 3 turned assignment emails off.
+	if !slices.Equal(recipients, []int{2, 4}) {
+		t.Errorf("email recipients = %v, want [2 4]", recipients)
+	}
+}
+
+func TestNotifyWithoutRecipientsDoesNothing(t *testing.T) {
+	fake := useFakeDB(t, nil)
+	notify(db, []NotificationEvent{{EventType: notifyComment, Title: "No one"}})
+	if len(fake.calls) != 0 {
+		t.Errorf("unexpected database calls %v", fake.calls)
+	}
+}
+
+func TestExecuteEmailTemplate(t *testing.T) {
+	due := time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		template    EmailTemplate
+		data        EmailData
+		wantSubject string
+		wantBody    []string
+		wantErr     bool
+	}{
+		{
+			name:        "assignment default",
+			template:    defaultEmailTemplates[notifyAssignment],
+			data:        EmailData{Title: "You were assigned to bug \"Crash\"", Body: "Please look today"},
+			wantSubject: `You were assigned to bug "Crash"`,
+			wantBody:    []string{"Please look today", "Open the project manager"},
+		},
+		{
+			name:        "digest default",
+			template:    defaultEmailTemplates[notifyDigest],
+			data:        EmailData{Date: "2026-10-19", Overdue: []TodoItem{{Kind: "work", Name: "Spec", ProjectName: "Apollo", TargetDate: due}}},
+			wantSubject: "Your deadlines on 2026-10-19",
+			wantBody:    []string{"Overdue:\n- Spec (work, due 2026-10-20) in Apollo"},
+		},
+		{
+			name:        "subject is kept on one line",
+			template:    EmailTemplate{Subject: "{{.Title}}\n  now", Body: "{{.Body}}"},
+			data:        EmailData{Title: "Line\r\nbreak", Body: "body"},
+			wantSubject: "Line break now",
+			wantBody:    []string{"body"},
+		},
+		{
+			name:     "parse error",
+			template: EmailTemplate{Subject: "{{.Title", Body: ""},
+			wantErr:  true,
+		},
+		{
+			name:     "unknown field",
+			template: EmailTemplate{Subject: "{{.Missing}}", Body: ""},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subject, body, err := executeEmailTemplate(tt.template, tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if subject != tt.wantSubject {
+				t.Errorf("subject = %q, want %q", subject, tt.wantSubject)
+			}
+			for _, part := range tt.wantBody {
+				if !strings.Contains(body, part) {
+					t.Errorf("body %q does not contain %q", body, part)
+				}
+			}
+		})
+	}
+}
+
+func TestPostEmailDigestsBucketsItems(t *testing.T) {
+	today := dateOnly(time.Now())
+	item := func(id int, name string, days int) map[string]any {
+		return map[string]any{"workId": id, "workName": name, "projectName": "Apollo", "targetDate": today.AddDate(0, 0, days).Format("2006-01-02")}
+	}
+	todoLists := map[int64]string{
+		1: mustJSON(t, []any{item(1, "Overdue spec", -3), item(2, "Due tomorrow", 1), item(3, "Due today", 0), item(4, "Next month", 30)}),
+		2: mustJSON(t, []any{item(5, "Far away", 10)}),
+		3: mustJSON(t, []any{item(6, "Opted out", -1)}),
+	}
+	fake := useFakeDB(t, map[string]func([]any) (any, error){
+		"get_email_recipients":            returns("[1,2,3]"),
+		"get_notification_preferences_of": returns(mustJSON(t, []map[string]any{{"userId": 3, "eventType": notifyDigest, "inApp": true, "email": false}})),
+		"get_email_template":              returns(nil),
+		"get_user_todo_list": func(args []any) (any, error) {
+			return todoLists[int64(args[0].(int))], nil
+		},
+	})
+
+	recorder := serve(postEmailDigests, http.MethodPost, "/postEmailDigests", nil, cronHeader(t))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", recorder.Code, recorder.Body)
+	}
+	calls := fake.callsTo("post_emails")
+	if len(calls) != 1 {
+		t.Fatalf("post_emails called %d times, want 1", len(calls))
+	}
+	var emails []QueuedEmailRequest
+	if err := json.Unmarshal([]byte(calls[0].Args[0].(string)), &emails); err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != 1 || emails[0].UserId != 1 {
+		t.Fatalf("digests = %+v, want one for user 1", emails)
+	}
+	body := emails[0].Body
+	overdue, dueSoon, found := strings.Cut(body, "Due soon:")
+	if !found {
+		t.Fatalf("digest has no due soon section: %q", body)
+	}
+	if !strings.Contains(overdue, "Overdue spec") || strings.Contains(overdue, "Due tomorrow") {
+		t.Errorf("overdue section = %q", overdue)
+	}
+	if !strings.Contains(dueSoon, "Due today") || !strings.Contains(dueSoon, "Due tomorrow") || strings.Contains(body, "Next month") {
+		t.Errorf("due soon section = %q", dueSoon)
+	}
+	if want := fmt.Sprintf("digest:1:%s", today.Format(time.DateOnly)); emails[0].DedupeKey != want {
+		t.Errorf("dedupe key = %q, want %q", emails[0].DedupeKey, want)
+	}
+}
+
+func TestPostProcessEmailQueueRetriesAndGivesUp(t *testing.T) {
+	queued := []QueuedEmail{
+		{EmailId: 1, ToAddress: "ok@example.com", Subject: "Hello", Body: "Hi", Attempts: 0},
+		{EmailId: 2, ToAddress: "down@example.com", Subject: "Retry", Body: "Hi", Attempts: 2},
+		{EmailId: 3, ToAddress: "down@example.com", Subject: "Last", Body: "Hi", Attempts: maxEmailAttempts - 1},
+	}
+	fake := useFakeDB(t, map[string]func([]any) (any, error){
+		"get_due_emails": returns(mustJSON(t, queued)),
+	})
+	sender := &fakeMailer{failFor: []string{"down@example.com"}}
+	useMailer(t, sender)
+
+	before := time.Now()
+	recorder := serve(postProcessEmailQueue, http.MethodPost, "/postProcessEmailQueue", nil, cronHeader(t))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", recorder.Code, recorder.Body)
+	}
+	if len(sender.sent) != 1 || sender.sent[0].To != "ok@example.com" {
+		t.Errorf("sent = %+v", sender.sent)
+	}
+	if calls := fake.callsTo("put_email_sent"); len(calls) != 1 || calls[0].Args[0] != int64(1) && calls[0].Args[0] != 1 {
+		t.Errorf("put_email_sent calls = %+v", calls)
+	}
+
+	failed := fake.callsTo("put_email_failed")
+	if len(failed) != 2 {
+		t.Fatalf("put_email_failed called %d times, want 2", len(failed))
+	}
+	next, ok := failed[0].Args[2].(*time.Time)
+	if !ok || next == nil {
+		t.Fatalf("email 2 was not rescheduled: %#v", failed[0].Args[2])
+	}
+	if delay := next.Sub(before); delay < retryDelay(3) || delay > retryDelay(3)+time.Minute {
+		t.Errorf("email 2 retried after %v, want about %v", delay, retryDelay(3))
+	}
+	if next, _ := failed[1].Args[2].(*time.Time); next != nil {
+		t.Errorf("email 3 rescheduled at %v after its last attempt", next)
+	}
+}
+
+func TestPostProcessEmailQueueWithoutSender(t *testing.T) {
+	fake := useFakeDB(t, nil)
+	useMailer(t, nil)
+	recorder := serve(postProcessEmailQueue, http.MethodPost, "/postProcessEmailQueue", nil, cronHeader(t))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", recorder.Code)
+	}
+	if len(fake.calls) != 0 {
+		t.Errorf("emails were claimed without a sender: %v", fake.calls)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{1: time.Minute, 2: 2 * time.Minute, 5: 16 * time.Minute} {
+		if got := retryDelay(attempts); got != want {
+			t.Errorf("retryDelay(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+// smtpStub accepts one SMTP session and returns the envelope and raw message it received.
+func smtpStub(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		reply := func(line string) { fmt.Fprintf(conn, "%s\r\n", line) }
+		var session strings.Builder
+		reply("220 localhost ESMTP stub")
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			verb := strings.ToUpper(strings.Fields(line + " x")[0])
+			switch verb {
+			case "EHLO", "HELO":
+				reply("250 localhost")
+			case "MAIL", "RCPT":
+				session.WriteString(line)
+				reply("250 OK")
+			case "DATA":
+				reply("354 End data with <CR><LF>.<CR><LF>")
+				for {
+					dataLine, err := reader.ReadString('\n')
+					if err != nil || dataLine == ".\r\n" {
+						break
+					}
+					session.WriteString(dataLine)
+				}
+				reply("250 OK")
+			case "QUIT":
+				reply("221 Bye")
+				received <- session.String()
+				return
+			default:
+				reply("502 Not implemented")
+			}
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+func TestSMTPMailSenderAgainstStub(t *testing.T) {
+	addr, received := smtpStub(t)
+	sender := smtpMailSender{addr: addr, from: "pm@example.com"}
+	err := sender.Send(EmailMessage{To: "dev@example.com", Subject: "Grüße from the project", Body: "line one\nline two\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var session string
+	select {
+	case session = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stub received no message")
+	}
+	for _, want := range []string{
+		"MAIL FROM:<pm@example.com>",
+		"RCPT TO:<dev@example.com>",
+		"From: pm@example.com\r\n",
+		"To: dev@example.com\r\n",
+		"Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe_from_the_project?=\r\n",
+		"Content-Type: text/plain; charset=utf-8\r\n",
+		"\r\n\r\nline one\r\nline two\r\n",
+	} {
+		if !strings.Contains(session, want) {
+			t.Errorf("session does not contain %q:\n%s", want, session)
+		}
+	}
+}
+
+func TestValidateWebhookRefusesInternalTargets(t *testing.T) {
+	for _, target := range []string{
+		"http://127.0.0.1/hook",
+		"http://localhost:8080/hook",
+		"https://10.1.2.3/hook",
+		"https://192.168.0.10/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://[::1]/hook",
+		"http://[fe80::1]/hook",
+		"http://0.0.0.0/hook",
+		"ftp://203.0.113.7/hook",
+	} {
+		if err := validateWebhook(context.Background(), &target, nil); err == nil {
+			t.Errorf("validateWebhook accepted %s", target)
+		}
+	}
+	public := "https://203.0.113.7/hook"
+	if err := validateWebhook(context.Background(), &public, []string{webhookWorkCreated}); err != nil {
+		t.Errorf("validateWebhook(%s) = %v", public, err)
+	}
+}
+
+func TestWebhookClientRefusesLoopback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the webhook reached a loopback receiver")
+	}))
+	defer server.Close()
+	_, _, err := sendWebhook(WebhookDelivery{DeliveryId: 1, TargetUrl: server.URL, Payload: "{}"})
+	if err == nil || !strings.Contains(err.Error(), "loopback") {
+		t.Errorf("error = %v, want the address to be refused", err)
+	}
+}
+
+func TestPutReopenBugEmitsEvents(t *testing.T) {
+	bug := mustJSON(t, WorkStateContext{WorkId: 12, WorkName: "Crash on save", ProjectId: 3, CurrentState: 5, IsBug: true})
+	fake := useFakeDB(t, map[string]func([]any) (any, error){
+		"get_work_state_context":            returns(bug),
+		"get_work_state_context_for_update": returns(bug),
+		"get_workflow":                      returns(nil),
+		"get_bug_resolution":                returns("fixed"),
+		"get_work_watchers":                 returns("[7]"),
+		"get_notification_preferences_of":   returns("[]"),
+		"get_email_template":                returns(nil),
+	})
+
+	body := strings.NewReader(`{"bugId":12,"reopenState":2,"reopenedBy":4,"reason":"Still crashes"}`)
+	recorder := serve(putReopenBug, http.MethodPut, "/putReopenBug", body, nil)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", recorder.Code, recorder.Body)
+	}
+	var events []string
+	for _, call := range fake.callsTo("post_webhook_event") {
+		events = append(events, call.Args[1].(string))
+	}
+	if !slices.Equal(events, []string{webhookBugUpdated, webhookBugStateChanged}) {
+		t.Errorf("webhook events = %v", events)
+	}
+	if calls := fake.callsTo("post_notifications"); len(calls) != 1 || !strings.Contains(calls[0].Args[0].(string), notifyStateChanged) {
+		t.Errorf("notifications = %+v, want the watcher told about the state change", calls)
+	}
+}
+
+func TestMemoryEventsWaitForCommit(t *testing.T) {
+	t.Setenv("REALTIME_BACKEND", "memory")
+	useFakeDB(t, nil)
+	events, unsubscribe := projectEvents.subscribe(3)
+	defer unsubscribe()
+	received := func() []string {
+		var got []string
+		for {
+			select {
+			case event := <-events:
+				got = append(got, event.Entity+"."+event.Action)
+			default:
+				return got
+			}
+		}
+	}
+
+	rolledBack, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishProjectEvent(rolledBack, 3, "work", "updated", nil)
+	rollbackTx(rolledBack)
+	if got := received(); len(got) != 0 {
+		t.Errorf("rolled back transaction published %v", got)
+	}
+
+	committed, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishProjectEvent(committed, 3, "bug", "updated", nil)
+	publishProjectEvent(committed, 3, "assignment", "updated", nil)
+	if got := received(); len(got) != 0 {
+		t.Errorf("events published before commit: %v", got)
+	}
+	if err := commitTx(committed); err != nil {
+		t.Fatal(err)
+	}
+	if got := received(); !slices.Equal(got, []string{"bug.updated", "assignment.updated"}) {
+		t.Errorf("events after commit = %v", got)
+	}
+
+	publishProjectEvent(db, 3, "module", "created", nil)
+	if got := received(); !slices.Equal(got, []string{"module.created"}) {
+		t.Errorf("events outside a transaction = %v", got)
+	}
+}
+
+// chatTestDB answers the queries of chat commands for user 4, a member of project 3, which
+// holds work 42 in state 1 and bug 43.
+func chatTestDB(t *testing.T) *fakeDB {
+	t.Helper()
+	work := func(args []any) (any, error) {
+		switch args[0] {
+		case 42, int64(42):
+			return mustJSON(t, WorkStateContext{WorkId: 42, WorkName: "Login page", ProjectId: 3, PriorityId: 2, CurrentState: 1}), nil
+		case 43, int64(43):
+			return mustJSON(t, WorkStateContext{WorkId: 43, WorkName: "Secret", ProjectId: 8, CurrentState: 1}), nil
+		case 60, int64(60):
+			return mustJSON(t, WorkStateContext{WorkId: 60, WorkName: "Button does nothing", ProjectId: 3, IsBug: true, CurrentState: 1}), nil
+		}
+		return nil, sql.ErrNoRows
+	}
+	lookups := ImportLookups{
+		States:       []LookupItem{{Id: 1, Name: "Open"}, {Id: 2, Name: "In Progress"}, {Id: 3, Name: "Done"}},
+		DefectCauses: []LookupItem{{Id: 5, Name: "Logic"}},
+	}
+	return useFakeDB(t, map[string]func([]any) (any, error){
+		"get_user_by_chat_id":               returns(4),
+		"get_work_state_context":            work,
+		"get_work_state_context_for_update": work,
+		"get_project_member_ids": func(args []any) (any, error) {
+			if args[0] == 3 || args[0] == int64(3) {
+				return "[4,9]", nil
+			}
+			return "[1]", nil
+		},
+		"get_import_lookups":              returns(mustJSON(t, lookups)),
+		"post_new_bug":                    returns(60),
+		"get_workflow":                    returns(nil),
+		"get_work_watchers":               returns("[]"),
+		"get_notification_preferences_of": returns("[]"),
+		"get_email_template":              returns(nil),
+		"get_user_todo_list":              returns(`[{"workId":42,"workName":"Login page","projectName":"Apollo","targetDate":"2026-10-01"}]`),
+	})
+}
+
+func slackHeader(secret, timestamp, body string) http.Header {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + timestamp + ":" + body))
+	return http.Header{
+		"Content-Type":              {"application/x-www-form-urlencoded"},
+		"X-Slack-Request-Timestamp": {timestamp},
+		"X-Slack-Signature":         {"v0=" + hex.EncodeToString(mac.Sum(nil))},
+	}
+}
+
+func TestPostChatCommandVerifiesRequests(t *testing.T) {
+	body := "team_id=T1&user_id=U1&command=%2Fpm&text=help"
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-maxChatRequestAge-time.Minute).Unix(), 10)
+	tests := []struct {
+		name       string
+		secret     string
+		token      string
+		body       string
+		header     http.Header
+		wantStatus int
+	}{
+		{"valid slack signature", "signing", "", body, slackHeader("signing", now, body), http.StatusOK},
+		{"bad slack signature", "signing", "", body, slackHeader("other", now, body), http.StatusUnauthorized},
+		{"tampered body", "signing", "", body + "x", slackHeader("signing", now, body), http.StatusUnauthorized},
+		{"stale timestamp", "signing", "", body, slackHeader("signing", stale, body), http.StatusUnauthorized},
+		{"missing timestamp", "signing", "", body, http.Header{}, http.StatusUnauthorized},
+		{"mattermost token", "", "mm-token", body + "&token=mm-token", nil, http.StatusOK},
+		{"wrong mattermost token", "", "mm-token", body + "&token=guess", nil, http.StatusUnauthorized},
+		{"not configured", "", "", body, nil, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chatTestDB(t)
+			t.Setenv("CHAT_SIGNING_SECRET", tt.secret)
+			t.Setenv("CHAT_COMMAND_TOKEN", tt.token)
+			recorder := serve(postChatCommand, http.MethodPost, "/postChatCommand", strings.NewReader(tt.body), tt.header)
+			if recorder.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d, body %s", recorder.Code, tt.wantStatus, recorder.Body)
+			}
+			if tt.wantStatus == http.StatusOK && !strings.Contains(recorder.Body.String(), "Usage:") {
+				t.Errorf("reply = %s, want the help text", recorder.Body)
+			}
+		})
+	}
+}
+
+func TestRunChatCommand(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		wantType  string
+		wantText  string
+		wantCalls []string
+	}{
+		{"help", "help", "ephemeral", "Usage:", nil},
+		{"empty", "", "ephemeral", "Usage:", nil},
+		{"todo", "TODO", "ephemeral", "work #42 Login page, due 2026-10-01 (overdue) in Apollo", nil},
+		{"new bug", "bug new #42 Button does nothing", "in_channel", `Bug "Button does nothing" reported against work #42 Login page.`, []string{"post_new_bug"}},
+		{"new bug without title", "bug new 42", "ephemeral", "Usage:", nil},
+		{"new bug with a bad ID", "bug new x Title", "ephemeral", "must be a number", nil},
+		{"new bug on an unknown work", "bug new 99 Title", "ephemeral", "Work #99 was not found.", nil},
+		{"new bug outside the user's projects", "bug new 43 Title", "ephemeral", "Work #43 was not found.", nil},
+		{"move work", "work 42 in progress", "in_channel", "Moved work #42 Login page to in progress.", []string{"put_alter_work"}},
+		{"move work to an unknown state", "work 42 shipped", "ephemeral", `Unknown state "shipped", expected one of Open, In Progress, Done.`, nil},
+		{"move work outside the user's projects", "work 43 done", "ephemeral", "Work #43 was not found.", nil},
+		{"move work with a bad ID", "work abc done", "ephemeral", "must be a number", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := chatTestDB(t)
+			reply := runChatCommand(4, tt.text)
+			if reply.ResponseType != tt.wantType || !strings.Contains(reply.Text, tt.wantText) {
+				t.Errorf("reply = %+v, want %s containing %q", reply, tt.wantType, tt.wantText)
+			}
+			for _, name := range []string{"post_new_bug", "put_alter_work"} {
+				called := len(fake.callsTo(name)) > 0
+				if called != slices.Contains(tt.wantCalls, name) {
+					t.Errorf("%s called = %v", name, called)
+				}
+			}
+		})
+	}
+}
+
+func TestPostGitWebhookLinksOnlyKnownReferences(t *testing.T) {
+	t.Setenv("GIT_WEBHOOK_SECRET", "git-secret")
+	fake := useFakeDB(t, map[string]func([]any) (any, error){
+		"get_work_state_context": func(args []any) (any, error) {
+			switch args[0] {
+			case 45, int64(45):
+				return mustJSON(t, WorkStateContext{WorkId: 45, WorkName: "Export", ProjectId: 3}), nil
+			case 46, int64(46):
+				return mustJSON(t, WorkStateContext{WorkId: 46, WorkName: "Crash", ProjectId: 3, IsBug: true}), nil
+			}
+			return nil, sql.ErrNoRows
+		},
+	})
+
+	body := mustJSON(t, map[string]any{
+		"ref":        "refs/heads/feature",
+		"repository": map[string]any{"full_name": "team/app", "default_branch": "main"},
+		"commits": []map[string]any{{
+			"id":      "abc123",
+			"message": "Export rows for WORK-45 and BUG-46, see BUG-45, WORK-46 and WORK-99\n\nwork-45 again",
+			"url":     "https://git.example.com/team/app/commit/abc123",
+			"author":  map[string]any{"name": "Dana"},
+		}},
+	})
+	mac := hmac.New(sha256.New, []byte("git-secret"))
+	mac.Write([]byte(body))
+	header := http.Header{
+		"X-Github-Event":      {"push"},
+		"X-Hub-Signature-256": {"sha256=" + hex.EncodeToString(mac.Sum(nil))},
+	}
+
+	recorder := serve(postGitWebhook, http.MethodPost, "/postGitWebhook", strings.NewReader(body), header)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", recorder.Code, recorder.Body)
+	}
+	calls := fake.callsTo("post_git_links")
+	if len(calls) != 1 {
+		t.Fatalf("post_git_links called %d times, want 1", len(calls))
+	}
+	var links []GitLink
+	if err := json.Unmarshal([]byte(calls[0].Args[0].(string)), &links); err != nil {
+		t.Fatal(err)
+	}
+	var references []string
+	for _, link := range links {
+		references = append(references, fmt.Sprintf("%s:%d", link.Reference, link.WorkId))
+	}
+	if !slices.Equal(references, []string{"WORK-45:45", "BUG-46:46"}) {
+		t.Errorf("links = %v", references)
+	}
+	var response struct {
+		Unlinked []string `json:"unlinked"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	want := []string{"BUG-45: item is a work", "WORK-46: item is a bug", "WORK-99: not found"}
+	if !slices.Equal(response.Unlinked, want) {
+		t.Errorf("unlinked = %v, want %v", response.Unlinked, want)
+	}
+
+	header.Set("X-Hub-Signature-256", "sha256=00")
+	if recorder := serve(postGitWebhook, http.MethodPost, "/postGitWebhook", strings.NewReader(body), header); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("bad signature status = %d, want 401", recorder.Code)
+	}
+}
+
+func TestParseICSHolidays(t *testing.T) {
+	event := func(lines ...string) string {
+		return "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\n" + strings.Join(lines, "\r\n") + "\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+	}
+	tests := []struct {
+		name    string
+		ics     string
+		want    []string
+		wantErr bool
+	}{
+		{"single day", event("SUMMARY:New Year", "DTSTART;VALUE=DATE:20270101"), []string{"2027-01-01 New Year"}, false},
+		{"multi-day with exclusive end", event("SUMMARY:Eid", "DTSTART;VALUE=DATE:20270309", "DTEND;VALUE=DATE:20270311"), []string{"2027-03-09 Eid", "2027-03-10 Eid"}, false},
+		{"folded and escaped summary", event("SUMMARY:Founders\\, and", "  staff day", "DTSTART:20270601T000000Z"), []string{"2027-06-01 Founders, and staff day"}, false},
+		{"missing start", event("SUMMARY:Nothing"), nil, true},
+		{"invalid start", event("DTSTART:2027"), nil, true},
+		{"longer than a year", event("SUMMARY:Forever", "DTSTART;VALUE=DATE:20270101", "DTEND;VALUE=DATE:99991231"), nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			holidays, err := parseICSHolidays(strings.NewReader(tt.ics))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var got []string
+			for _, holiday := range holidays {
+				got = append(got, holiday.HolidayDate.Format("2006-01-02")+" "+holiday.HolidayName)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("holidays = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWorkingDaysMatchDayByDayCount(t *testing.T) {
+	calendar := &WorkingCalendar{
+		WorkingDays: []int{1, 2, 3, 4, 5},
+		Holidays: []Holiday{
+			{HolidayDate: time.Date(2026, 12, 25, 0, 0, 0, 0, time.UTC)},
+			{HolidayDate: time.Date(2026, 12, 25, 0, 0, 0, 0, time.UTC)},
+			{HolidayDate: time.Date(2026, 12, 26, 0, 0, 0, 0, time.UTC)}, // a Saturday
+			{HolidayDate: time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		},
+	}
+	countDays := func(wc *WorkingCalendar, start, end time.Time) int {
+		count := 0
+		for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+			if wc.isWorkingDay(day) {
+				count++
+			}
+		}
+		return count
+	}
+	first := time.Date(2026, 12, 1, 0, 0, 0, 0, time.UTC)
+	for _, wc := range []*WorkingCalendar{calendar, nil, {WorkingDays: []int{0, 6, 6}}} {
+		for offset := 0; offset < 30; offset++ {
+			start := first.AddDate(0, 0, offset)
+			for length := -2; length < 50; length++ {
+				end := start.AddDate(0, 0, length)
+				if got, want := wc.workingDaysBetween(start, end), countDays(wc, start, end); got != want {
+					t.Fatalf("workingDaysBetween(%s, %s) = %d, want %d", start.Format(time.DateOnly), end.Format(time.DateOnly), got, want)
+				}
+			}
+			for n := -40; n <= 40; n++ {
+				moved := wc.addWorkingDays(start, n)
+				if got := wc.workingDaysFrom(start, moved); got != n && wc.isWorkingDay(start) {
+					t.Fatalf("addWorkingDays(%s, %d) = %s, %d working days away", start.Format(time.DateOnly), n, moved.Format(time.DateOnly), got)
+				}
+				if n != 0 && !wc.isWorkingDay(moved) {
+					t.Fatalf("addWorkingDays(%s, %d) = %s, not a working day", start.Format(time.DateOnly), n, moved.Format(time.DateOnly))
+				}
+			}
+		}
+	}
+}
+
+func TestWorkingDaysBetweenCapsLongSpans(t *testing.T) {
+	calendar := &WorkingCalendar{WorkingDays: []int{1, 2, 3, 4, 5}}
+	start := time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)
+	got := calendar.workingDaysBetween(start, time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC))
+	if want := calendar.workingDaysBetween(start, start.AddDate(0, 0, maxCalendarSpanDays)); got != want || got <= 0 {
+		t.Errorf("workingDaysBetween up to 9999 = %d, want the capped %d", got, want)
+	}
+}
+
+func TestBuildVarianceReport(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2026, 10, d, 0, 0, 0, 0, time.UTC) }
+	ptr := func(t time.Time) *time.Time { return &t }
+	hours := func(h int) *int { return &h }
+	works := []BaselineWork{
+		// Friday to Monday: one working day later.
+		{WorkId: 1, BaselineStartDate: day(1), BaselineTargetDate: day(2), BaselineEstimatedHours: 8, CurrentStartDate: ptr(day(1)), CurrentTargetDate: ptr(day(5)), CurrentEstimatedHours: hours(12)},
+		// Wednesday to Monday: two working days earlier.
+		{WorkId: 2, BaselineStartDate: day(5), BaselineTargetDate: day(7), CurrentStartDate: ptr(day(5)), CurrentTargetDate: ptr(day(5))},
+		{WorkId: 3, BaselineStartDate: day(1), BaselineTargetDate: day(1)},
+	}
+	weekdays := &WorkingCalendar{WorkingDays: []int{1, 2, 3, 4, 5}}
+
+	tests := []struct {
+		name                             string
+		calendar                         *WorkingCalendar
+		wantSlip, wantPullIn, wantFinish int
+	}{
+		{"working days", weekdays, 1, 2, -2},
+		{"every day without a calendar", nil, 3, 2, -2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := buildVarianceReport(works, tt.calendar)
+			if len(report.SlippedWorks) != 1 || report.SlippedWorks[0].WorkId != 1 {
+				t.Fatalf("slipped works = %+v", report.SlippedWorks)
+			}
+			if len(report.PulledInWorks) != 1 || report.PulledInWorks[0].WorkId != 2 {
+				t.Fatalf("pulled in works = %+v", report.PulledInWorks)
+			}
+			if len(report.DroppedWorks) != 1 || report.DroppedWorks[0].WorkId != 3 {
+				t.Errorf("dropped works = %+v", report.DroppedWorks)
+			}
+			if report.TotalSlipDays != tt.wantSlip || report.TotalPullInDays != tt.wantPullIn {
+				t.Errorf("slip/pull-in = %d/%d, want %d/%d", report.TotalSlipDays, report.TotalPullInDays, tt.wantSlip, tt.wantPullIn)
+			}
+			if report.FinishVarianceDays != tt.wantFinish {
+				t.Errorf("finish variance = %d, want %d", report.FinishVarianceDays, tt.wantFinish)
+			}
+			if got := report.SlippedWorks[0].EstimateVarianceHours; got != 4 {
+				t.Errorf("estimate variance = %d, want 4", got)
+			}
+		})
+	}
+}
+
+func TestPutAlterTimeEntryLocksEntryBeforeWeeks(t *testing.T) {
+	entry := mustJSON(t, TimeEntry{TimeEntryId: 5, UserId: 2, EntryDate: time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC), Hours: 4})
+	states := map[string]string{"2026-10-12": timesheetDraft, "2026-10-05": timesheetApproved}
+	fake := useFakeDB(t, map[string]func([]any) (any, error){
+		"get_time_entry_for_update": returns(entry),
+		"get_timesheet_state_for_update": func(args []any) (any, error) {
+			return states[args[1].(time.Time).Format(time.DateOnly)], nil
+		},
+	})
+
+	body := strings.NewReader(`{"timeEntryId":5,"entryDate":"2026-10-06T00:00:00Z"}`)
+	recorder := serve(putAlterTimeEntry, http.MethodPut, "/putAlterTimeEntry", body, nil)
+	if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), "approved") {
+		t.Fatalf("status = %d, body %s, want the approved week to refuse the move", recorder.Code, recorder.Body)
+	}
+	var order []string
+	for _, call := range fake.calls {
+		order = append(order, call.Name)
+	}
+	want := []string{"get_time_entry_for_update", "get_timesheet_state_for_update"}
+	if len(order) < 2 || !slices.Equal(order[:2], want) {
+		t.Errorf("calls = %v, want the entry locked before its week", order)
+	}
+	if len(fake.callsTo("put_alter_time_entry")) != 0 {
+		t.Error("the entry was moved into an approved week")
+	}
+}
+
+func TestChangeTimesheetStateMessages(t *testing.T) {
+	tests := []struct {
+		name    string
+		state   func([]any) (any, error)
+		wantMsg string
+	}{
+		{"invalid transition", returns(timesheetApproved), "cannot move a timesheet from approved to submitted"},
+		{"database error", func([]any) (any, error) { return nil, errors.New(`pq: relation "secret" does not exist`) }, "Failed to change timesheet state"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeDB(t, map[string]func([]any) (any, error){"get_timesheet_state_for_update": tt.state})
+			body := strings.NewReader(`{"userId":2,"weekStart":"2026-10-12T00:00:00Z"}`)
+			recorder := serve(putSubmitTimesheet, http.MethodPut, "/putSubmitTimesheet", body, nil)
+			if recorder.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d", recorder.Code)
+			}
+			var response struct{ Error string }
+			json.Unmarshal(recorder.Body.Bytes(), &response)
+			if !strings.Contains(response.Error, tt.wantMsg) || strings.Contains(response.Error, "secret") {
+				t.Errorf("error = %q, want %q", response.Error, tt.wantMsg)
+			}
+		})
+	}
+}
+
+func TestDailyCapacityDropsHolidays(t *testing.T) {
+	calendar := &WorkingCalendar{
+		WorkingDays: []int{1, 2, 3, 4, 5},
+		Holidays:    []Holiday{{HolidayDate: time.Date(2026, 12, 25, 0, 0, 0, 0, time.UTC)}},
+	}
+	weekStart := time.Date(2026, 12, 21, 0, 0, 0, 0, time.UTC)
+	total := 0.0
+	for day := weekStart; day.Before(weekStart.AddDate(0, 0, 7)); day = day.AddDate(0, 0, 1) {
+		hours := dailyCapacity(40, calendar, day)
+		if calendar.isWorkingDay(day) && hours != 8 {
+			t.Errorf("capacity on %s = %v, want 8", day.Format(time.DateOnly), hours)
+		}
+		total += hours
+	}
+	if total != 32 {
+		t.Errorf("capacity of a week with a holiday = %v, want 32", total)
+	}
+}
+
+func TestRankForPosition(t *testing.T) {
+	cards := func(ranks ...float64) []BoardCard {
+		result := make([]BoardCard, len(ranks))
+		for i, rank := range ranks {
+			result[i] = BoardCard{WorkId: i + 1, Rank: rank}
+		}
+		return result
+	}
+	tests := []struct {
+		name           string
+		cards          []BoardCard
+		position       int
+		wantRank       float64
+		wantRenumbered []float64
+	}{
+		{"empty column", nil, 0, 1, nil},
+		{"top", cards(2, 3), 0, 1, nil},
+		{"bottom", cards(2, 3), 2, 4, nil},
+		{"past the bottom", cards(2, 3), 9, 4, nil},
+		{"before the top", cards(2, 3), -4, 1, nil},
+		{"between", cards(1, 2), 1, 1.5, nil},
+		{"no gap left", cards(1, 1+minRankGap/2, 3), 1, 2, []float64{1, 3, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rank, renumbered := rankForPosition(tt.cards, tt.position)
+			if rank != tt.wantRank {
+				t.Errorf("rank = %v, want %v", rank, tt.wantRank)
+			}
+			var ranks []float64
+			for _, card := range renumbered {
+				ranks = append(ranks, card.Rank)
+			}
+			if !slices.Equal(ranks, tt.wantRenumbered) {
+				t.Errorf("renumbered = %v, want %v", ranks, tt.wantRenumbered)
+			}
+		})
+	}
+}
+
+func TestPutMoveBoardCardLocksCardFirst(t *testing.T) {
+	card := mustJSON(t, WorkStateContext{WorkId: 42, ProjectId: 3, CurrentState: 1})
+	fake := useFakeDB(t, map[string]func([]any) (any, error){
+		"get_work_state_context_for_update": returns(card),
+		"get_workflow":                      returns(nil),
+	})
+	serve(putMoveBoardCard, http.MethodPut, "/putMoveBoardCard", strings.NewReader(`{"workId":42,"toStateId":2}`), nil)
+	if len(fake.calls) == 0 || fake.calls[0].Name != "get_work_state_context_for_update" {
+		t.Errorf("calls = %+v, want the card locked first", fake.calls)
+	}
+	if len(fake.callsTo("get_work_state_context")) != 0 {
+		t.Error("the card was read without its lock")
+	}
+}
+
+func TestGetProjectVelocityLoadsSprintsInOneCall(t *testing.T) {
+	start := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+	done := start.AddDate(0, 0, 3)
+	sprint := func(id int, offset int) map[string]any {
+		return map[string]any{
+			"sprint": Sprint{SprintId: id, SprintName: "S" + strconv.Itoa(id), StartDate: start.AddDate(0, 0, offset), EndDate: start.AddDate(0, 0, offset+9), SprintDone: true},
+			"works":  []SprintWork{{WorkId: id, EstimatedHours: 8, AddedAt: start.AddDate(0, 0, offset), CompletedAt: &done}},
+		}
+	}
+	fake := useFakeDB(t, map[string]func([]any) (any, error){
+		"get_project_finished_sprint_works": returns(mustJSON(t, []map[string]any{sprint(2, 14), sprint(1, 0)})),
+	})
+
+	recorder := serve(getProjectVelocity, http.MethodGet, "/velocity?projectId=7", nil, nil)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", recorder.Code, recorder.Body)
+	}
+	if calls := len(fake.calls); calls != 1 {
+		t.Fatalf("database calls = %d, want 1", calls)
+	}
+	var response struct {
+		Sprints []SprintVelocity `json:"sprints"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Sprints) != 2 || response.Sprints[0].SprintId != 1 {
+		t.Errorf("sprints = %+v, want both sprints ordered by start date", response.Sprints)
+	}
+}
+
+func TestBuildProjectDashboardSubModuleWindows(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2026, 3, d, 0, 0, 0, 0, time.UTC) }
+	project := MetricProject{ProjectId: 1, ProjectName: "P", StartDate: day(2), TargetDate: day(27)}
+	works := []MetricWork{
+		{WorkId: 1, ModuleId: 1, SubModuleId: 10, SubModuleStartDate: day(2), SubModuleTargetDate: day(13), TargetDate: day(27), EstimatedHours: 8},
+		{WorkId: 2, ModuleId: 1, SubModuleId: 20, SubModuleStartDate: day(16), SubModuleTargetDate: day(27), TargetDate: day(27), EstimatedHours: 8},
+		{WorkId: 3, ModuleId: 1, SubModuleId: 30, TargetDate: day(27), EstimatedHours: 8},
+	}
+	calendar := &WorkingCalendar{WorkingDays: []int{1, 2, 3, 4, 5}}
+
+	dashboard := buildProjectDashboard(project, works, calendar, 3, day(16).Add(9*time.Hour))
+	if dashboard.Project.ExpectedPercent != 50 {
+		t.Errorf("project expected = %v, want 50", dashboard.Project.ExpectedPercent)
+	}
+	want := map[int]struct {
+		expected float64
+		health   string
+	}{
+		10: {100, healthLate},
+		20: {0, healthOnTrack},
+		30: {50, healthLate},
+	}
+	for _, metrics := range dashboard.SubModules {
+		if got := want[metrics.Id]; metrics.ExpectedPercent != got.expected || metrics.ScheduleHealth != got.health {
+			t.Errorf("sub-module %d = %v%% %s, want %v%% %s", metrics.Id, metrics.ExpectedPercent, metrics.ScheduleHealth, got.expected, got.health)
+		}
+	}
+}
+
+func TestBuildBugAnalytics(t *testing.T) {
+	start := time.Date(2026, 9, 7, 0, 0, 0, 0, time.UTC) // a Monday
+	end := start.AddDate(0, 0, 13)
+	at := func(days int) *time.Time { t := start.AddDate(0, 0, days); return &t }
+	cause, subModule := 4, 9
+	bugs := []BugFact{
+		{BugId: 1, CreatedAt: *at(0), ResolvedAt: at(2), DefectCauseId: &cause, DefectCauseName: "Logic", SubModuleId: &subModule, SubModuleName: "Auth", PriorityId: 1, PriorityName: "High"},
+		{BugId: 2, CreatedAt: *at(1), ReopenCount: 1, DefectCauseId: &cause, DefectCauseName: "Logic", SubModuleId: &subModule, SubModuleName: "Auth", PriorityId: 2, PriorityName: "Low"},
+		{BugId: 3, CreatedAt: *at(8), PriorityId: 2, PriorityName: "Low"},
+	}
+	carriedIn := []BugFact{
+		{BugId: 10, CreatedAt: start.AddDate(0, 0, -20)},
+		{BugId: 11, CreatedAt: start.AddDate(0, 0, -20), ResolvedAt: at(9)},
+	}
+	subModules := []SubModuleSize{{SubModuleId: subModule, SubModuleName: "Auth", WorkCount: 4, EstimatedHours: 50}}
+
+	analytics := buildBugAnalytics(bugs, carriedIn, subModules, start, end)
+	if analytics.BugCount != 3 || analytics.ResolvedCount != 1 || analytics.CarriedInCount != 2 {
+		t.Errorf("counts = %d/%d/%d", analytics.BugCount, analytics.ResolvedCount, analytics.CarriedInCount)
+	}
+	// Bug 2 was resolved once and reopened, bug 1 is resolved: one reopen out of two.
+	if analytics.ReopenRatePercent != 50 {
+		t.Errorf("reopen rate = %v, want 50", analytics.ReopenRatePercent)
+	}
+	if analytics.MeanTimeToResolveHours != 48 {
+		t.Errorf("mean time to resolve = %v, want 48", analytics.MeanTimeToResolveHours)
+	}
+	if len(analytics.ByDefectCause) == 0 || analytics.ByDefectCause[0].Name != "Logic" || analytics.ByDefectCause[0].Count != 2 {
+		t.Errorf("by defect cause = %+v", analytics.ByDefectCause)
+	}
+	if len(analytics.DefectDensity) != 1 || analytics.DefectDensity[0].BugsPerWork != 0.5 || analytics.DefectDensity[0].BugsPer100Hours != 4 {
+		t.Errorf("defect density = %+v", analytics.DefectDensity)
+	}
+
+	want := []BugTrendPoint{
+		{WeekStart: start, Opened: 2, Resolved: 1, OpenAtEnd: 3},
+		{WeekStart: start.AddDate(0, 0, 7), Opened: 1, Resolved: 1, OpenAtEnd: 3},
+	}
+	if !slices.Equal(analytics.WeeklyTrend, want) {
+		t.Errorf("weekly trend = %+v, want %+v", analytics.WeeklyTrend, want)
+	}
+}
+
+func TestGetBugAnalyticsCapsRange(t *testing.T) {
+	fake := useFakeDB(t, map[string]func([]any) (any, error){
+		"get_bug_analytics_source": returns(`{"bugs":[],"carriedIn":[],"subModules":[]}`),
+	})
+
+	recorder := serve(getBugAnalytics, http.MethodGet, "/bugs?projectId=1&startDate=2020-01-01&endDate=2026-01-01", nil, nil)
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", recorder.Code, http.StatusBadRequest)
+	}
+	if calls := fake.callsTo("get_bug_analytics_source"); len(calls) != 0 {
+		t.Errorf("analytics source loaded for an oversized range")
+	}
+
+	recorder = serve(getBugAnalytics, http.MethodGet, "/bugs?projectId=1&startDate=2025-01-01&endDate=2026-01-01", nil, nil)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d, body %s", recorder.Code, http.StatusOK, recorder.Body)
+	}
+}
+
+func TestProjectStructureKeepsWorkingDayOffsets(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2026, 3, d, 0, 0, 0, 0, time.UTC) }
+	calendar := &WorkingCalendar{WorkingDays: []int{1, 2, 3, 4, 5}}
+	structure := func() ProjectStructure {
+		return ProjectStructure{
+			StartDate:  day(6), // a Friday
+			TargetDate: day(13),
+			SubModules: []StructureSubModule{{
+				StartDate:  day(6),
+				TargetDate: day(10),
+				Works:      []StructureWork{{StartDate: day(9), TargetDate: day(10)}},
+			}},
+		}
+	}
+
+	template := structureToTemplate(structure(), calendar)
+	if work := template.SubModules[0].Works[0]; template.DurationDays != 5 || work.StartOffsetDays != 1 || work.DurationDays != 1 {
+		t.Fatalf("template = %d days, work offset %d for %d days, want 5, 1 and 1", template.DurationDays, work.StartOffsetDays, work.DurationDays)
+	}
+	instance := templateToStructure(template, day(16), calendar)
+	if work := instance.SubModules[0].Works[0]; !work.StartDate.Equal(day(17)) || !work.TargetDate.Equal(day(18)) || !instance.TargetDate.Equal(day(23)) {
+		t.Errorf("instantiated work %s to %s, project to %s", work.StartDate, work.TargetDate, instance.TargetDate)
+	}
+
+	template.WorkingDayOffsets = false
+	if legacy := templateToStructure(template, day(16), calendar); !legacy.TargetDate.Equal(day(21)) {
+		t.Errorf("calendar-day template ends %s, want %s", legacy.TargetDate, day(21))
+	}
+
+	moved := structure()
+	moveStructure(&moved, day(12), calendar)
+	if work := moved.SubModules[0].Works[0]; !work.StartDate.Equal(day(13)) || !work.TargetDate.Equal(day(16)) || !moved.TargetDate.Equal(day(19)) {
+		t.Errorf("moved work %s to %s, project to %s", work.StartDate, work.TargetDate, moved.TargetDate)
+	}
+}
+
+// xlsxWithSheet builds a workbook whose only sheet has the given sheetData content.
+func xlsxWithSheet(t *testing.T, sheetData string) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	archive := zip.NewWriter(&buffer)
+	for name, content := range map[string]string{
+		"xl/workbook.xml":            `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Works" sheetId="1" r:id="rId1"/></sheets></workbook>`,
+		"xl/_rels/workbook.xml.rels": `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Target="worksheets/sheet1.xml"/></Relationships>`,
+		"xl/worksheets/sheet1.xml":   `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>` + sheetData + `</sheetData></worksheet>`,
+	} {
+		writer, err := archive.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(writer, content)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestReadXLSX(t *testing.T) {
+	t.Run("round trip of an export", func(t *testing.T) {
+		var buffer bytes.Buffer
+		writer, err := newXLSXTableWriter(&buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, row := range [][]any{{"Work", "Hours", "Done"}, {"=cmd", 7.5, true}} {
+			if err := writer.WriteRow(row); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+		sheets, order, err := readXLSX(bytes.NewReader(buffer.Bytes()), int64(buffer.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(order, []string{"Export"}) {
+			t.Fatalf("sheets = %v", order)
+		}
+		rows := sheets["Export"]
+		if len(rows) != 2 || !slices.Equal(rows[0], []string{"Work", "Hours", "Done"}) || !slices.Equal(rows[1], []string{"=cmd", "7.5", "true"}) {
+			t.Errorf("rows = %q", rows)
+		}
+	})
+
+	t.Run("sparse cells", func(t *testing.T) {
+		data := xlsxWithSheet(t, `<row r="1"><c r="B1" t="inlineStr"><is><t>b</t></is></c><c r="D1"><v>4</v></c></row>`)
+		sheets, _, err := readXLSX(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sheets["Works"]; len(got) != 1 || !slices.Equal(got[0], []string{"", "b", "", "4"}) {
+			t.Errorf("rows = %q", got)
+		}
+	})
+
+	for _, ref := range []string{"1", "a1", "$A$1", "XFE1", "XFDZZZZ1", "AAAAAAAAAAAAAAA1"} {
+		t.Run("bad reference "+ref, func(t *testing.T) {
+			data := xlsxWithSheet(t, fmt.Sprintf(`<row r="1"><c r="%s"><v>1</v></c></row>`, ref))
+			if _, _, err := readXLSX(bytes.NewReader(data), int64(len(data))); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+
+	t.Run("oversized part", func(t *testing.T) {
+		var buffer bytes.Buffer
+		archive := zip.NewWriter(&buffer)
+		writer, err := archive.CreateRaw(&zip.FileHeader{Name: "xl/workbook.xml", Method: zip.Store, UncompressedSize64: maxXLSXUnpackedBytes + 1, CompressedSize64: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer.Write([]byte("<"))
+		archive.Close()
+		if _, _, err := readXLSX(bytes.NewReader(buffer.Bytes()), int64(buffer.Len())); err == nil || !strings.Contains(err.Error(), "uncompressed") {
+			t.Errorf("error = %v, want the size limit", err)
+		}
+	})
+}
+
+func TestXLSXColumnIndex(t *testing.T) {
+	for ref, want := range map[string]int{"A1": 0, "Z9": 25, "AA10": 26, "AZ3": 51, "XFD1048576": 16383} {
+		if got, err := xlsxColumnIndex(ref); err != nil || got != want {
+			t.Errorf("xlsxColumnIndex(%q) = %d, %v, want %d", ref, got, err, want)
+		}
+	}
+}
+
+func TestBuildImportPayloadWorkIds(t *testing.T) {
+	lookups := ImportLookups{
+		Priorities: []LookupItem{{Id: 1, Name: "Normal"}},
+		Trackers:   []LookupItem{{Id: 1, Name: "Feature"}},
+		Activities: []LookupItem{{Id: 1, Name: "Development"}},
+		SubModules: []LookupItem{{Id: 3, Name: "Login"}},
+		Works:      []LookupItem{{Id: 12, Name: "Form"}},
+	}
+	row := func(number, workId string) map[string]string {
+		return map[string]string{"#row": number, "work id": workId, "sub-module": "Login", "work": "Form", "start date": "2026-03-02",
+			"target date": "2026-03-06", "priority": "Normal", "tracker": "Feature", "activity": "Development"}
+	}
+
+	payload, report := buildImportPayload(1, 5, []map[string]string{row("2", "12"), row("3", "")}, nil, lookups)
+	if len(report.Issues) != 0 {
+		t.Fatalf("issues = %+v", report.Issues)
+	}
+	if payload.Works[0].WorkId == nil || *payload.Works[0].WorkId != 12 || payload.Works[1].WorkId != nil || report.UpdatedCount != 1 {
+		t.Errorf("work IDs = %v, %v, updated %d; want 12, nil and 1", payload.Works[0].WorkId, payload.Works[1].WorkId, report.UpdatedCount)
+	}
+
+	_, report = buildImportPayload(1, 5, []map[string]string{row("2", "99"), row("3", "1.5"), row("4", "12"), row("5", "12")}, nil, lookups)
+	var rows []int
+	for _, issue := range report.Issues {
+		if issue.Column == "Work ID" {
+			rows = append(rows, issue.Row)
+		}
+	}
+	if !slices.Equal(rows, []int{2, 3, 5}) {
+		t.Errorf("Work ID issues on rows %v, want [2 3 5]: %+v", rows, report.Issues)
+	}
+}
+
+func TestMSPDIHours(t *testing.T) {
+	tests := []struct {
+		duration string
+		want     int
+		ok       bool
+	}{
+		{"PT8H0M0S", 8, true},
+		{"PT7H30M0S", 8, true},
+		{"PT0H45M0S", 1, true},
+		{"PT480H0M0S", 480, true},
+		{"PT0H0M0S", 0, true},
+		{"P1D", 0, false},
+		{"PTxH0M0S", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := mspdiHours(tt.duration)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("mspdiHours(%q) = %d, %v, want %d, %v", tt.duration, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestBuildMSProjectImportLeavesSummaryAtItsLevel(t *testing.T) {
+	task := func(id, level int, name string, summary int) mspdiTask {
+		return mspdiTask{UID: id, ID: id, Name: name, OutlineLevel: level, Summary: summary, Start: "2026-03-02", Finish: "2026-03-06"}
+	}
+	project := mspdiProject{Title: "Plan", Tasks: []mspdiTask{
+		task(1, 1, "Backend", 1),
+		task(2, 2, "Auth", 1),
+		task(3, 3, "Login", 0),
+		task(4, 2, "Deploy", 0), // directly in Backend, after the Auth sub-module
+		task(5, 1, "Frontend", 1),
+		task(6, 3, "Menu", 0), // no sub-module opened inside Frontend
+	}}
+
+	payload, report := buildMSProjectImport(project, map[string]int{"projectId": 1}, ImportLookups{})
+	if len(report.Issues) != 0 {
+		t.Fatalf("issues = %+v", report.Issues)
+	}
+	want := map[string][2]string{
+		"Login":  {"Backend", "Auth"},
+		"Deploy": {"Backend", "Plan"},
+		"Menu":   {"Frontend", "Plan"},
+	}
+	for _, work := range payload.Works {
+		if got := [2]string{work.ModuleName, work.SubModuleName}; got != want[work.WorkName] {
+			t.Errorf("%s is in %v, want %v", work.WorkName, got, want[work.WorkName])
+		}
+	}
+	if len(payload.NewSubModules) != 3 {
+		t.Errorf("new sub-modules = %+v, want Auth and a default one per module", payload.NewSubModules)
+	}
+}
+
+func TestBuildICS(t *testing.T) {
+	events := []icsEvent{{
+		UID:         "work-7@project-manager",
+		Summary:     "Release, phase 1; final",
+		Description: strings.Repeat("ä", 60) + "\nsecond line",
+		Date:        time.Date(2026, 11, 2, 0, 0, 0, 0, time.UTC),
+	}}
+	body := string(buildICS("Team, deadlines", events))
+
+	if !strings.HasSuffix(body, "END:VCALENDAR\r\n") {
+		t.Errorf("calendar does not end with END:VCALENDAR")
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(body, "\r\n"), "\r\n") {
+		if len(line) > 75 {
+			t.Errorf("line longer than 75 octets: %q", line)
+		}
+		if !utf8Valid(line) {
+			t.Errorf("folding split a UTF-8 sequence: %q", line)
+		}
+	}
+	unfolded := strings.ReplaceAll(body, "\r\n ", "")
+	for _, want := range []string{
+		"X-WR-CALNAME:Team\\, deadlines\r\n",
+		"UID:work-7@project-manager\r\n",
+		"DTSTART;VALUE=DATE:20261102\r\n",
+		"DTEND;VALUE=DATE:20261103\r\n",
+		"SUMMARY:Release\\, phase 1\\; final\r\n",
+		"DESCRIPTION:" + strings.Repeat("ä", 60) + "\\nsecond line\r\n",
+	} {
+		if !strings.Contains(unfolded, want) {
+			t.Errorf("calendar does not contain %q", want)
+		}
+	}
+}
+
+func utf8Valid(s string) bool {
+	return strings.ToValidUTF8(s, "\uFFFD") == s
+}
+
+func TestGetUserCalendarFeedUnknownToken(t *testing.T) {
+	fake := useFakeDB(t, map[string]func([]any) (any, error){
+		"get_user_by_calendar_token": returns(nil),
+		"get_user_todo_list":         returns(`[]`),
+	})
+
+	recorder := serve(getUserCalendarFeed, http.MethodGet, "/feed?token=revoked", nil, nil)
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d, body %s", recorder.Code, http.StatusNotFound, recorder.Body)
+	}
+	if calls := fake.callsTo("get_user_todo_list"); len(calls) != 0 {
+		t.Errorf("todo list loaded for an unknown token")
+	}
+}
+
+func TestSchedulerEndpointsNeedSecret(t *testing.T) {
+	useFakeDB(t, nil)
+	t.Setenv("CRON_SECRET", "")
+	if recorder := serve(postProcessEmailQueue, http.MethodGet, "/postProcessEmailQueue", nil, nil); recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("without CRON_SECRET status = %d, want 503", recorder.Code)
+	}
+	header := cronHeader(t)
+	header.Set("Authorization", "Bearer wrong")
+	if recorder := serve(postProcessEmailQueue, http.MethodGet, "/postProcessEmailQueue", nil, header); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("with a wrong secret status = %d, want 401", recorder.Code)
+	}
+}
+
+func TestCreationNotifiesAssignees(t *testing.T) {
+	fake := useFakeDB(t, map[string]func([]any) (any, error){
+		"post_new_work": returns(70),
+		"post_new_bug":  returns(71),
+		"get_work_state_context": func(args []any) (any, error) {
+			id := fmt.Sprint(args[0])
+			return mustJSON(t, WorkStateContext{WorkId: map[string]int{"70": 70, "71": 71}[id], WorkName: "New", ProjectId: 3, IsBug: id == "71"}), nil
+		},
+		"get_notification_preferences_of": returns("[]"),
+		"get_email_template":              returns(nil),
+	})
+
+	pic := 2
+	body := mustJSON(t, NewWork{WorkName: "New", PicId: &pic, CreatedBy: 1, UsersAdded: []int{1, 2, 3}})
+	if recorder := serve(postNewWork, http.MethodPost, "/postNewWork", strings.NewReader(body), nil); recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", recorder.Code, recorder.Body)
+	}
+	if _, err := createBug(NewBug{WorkName: "New", PicId: &pic, CreatedBy: 1, WorkAffected: 70}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, call := range fake.callsTo("post_notifications") {
+		var rows []struct {
+			UserId    int  `json:"userId"`
+			WorkId    *int `json:"workId"`
+			ProjectId *int `json:"projectId"`
+		}
+		if err := json.Unmarshal([]byte(call.Args[0].(string)), &rows); err != nil {
+			t.Fatal(err)
+		}
+		for _, row := range rows {
+			if row.WorkId == nil || row.ProjectId == nil {
+				t.Fatalf("notification for user %d has no work or project", row.UserId)
+			}
+			got = append(got, fmt.Sprintf("%d:%d@%d", row.UserId, *row.WorkId, *row.ProjectId))
+		}
+	}
+	want := []string{"2:70@3", "3:70@3", "2:71@3"}
+	if !slices.Equal(got, want) {
+		t.Errorf("notifications = %v, want %v", got, want)
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1::1", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"169.254.169.254", false},
+		{"0.1.2.3", false},
+		{"100.64.0.1", false},
+		{"100.127.255.255", false},
+		{"198.18.0.1", false},
+		{"198.19.255.255", false},
+		{"255.255.255.255", false},
+		{"::ffff:10.0.0.1", false},
+		{"64:ff9b::a00:1", false},
+		{"fd00::1", false},
+		{"::", false},
+	}
+	for _, tt := range tests {
+		if got := isPublicIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("isPublicIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestPutAlterProjectAnnouncesAfterRoles(t *testing.T) {
+	t.Setenv("REALTIME_BACKEND", "memory")
+	fake := useFakeDB(t, nil)
+	events, unsubscribe := projectEvents.subscribe(3)
+	defer unsubscribe()
+
+	projectId := 3
+	body := mustJSON(t, AlterProject{ProjectId: &projectId, UserRoles: []UserRoleChange{{RoleId: 2, UsersAdded: []int{5}}}})
+	if recorder := serve(putAlterProject, http.MethodPut, "/putAlterProject", strings.NewReader(body), nil); recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", recorder.Code, recorder.Body)
+	}
+	var order []string
+	for _, call := range fake.calls {
+		if call.Name == "alter_user_project_role" || call.Name == "post_webhook_event" {
+			order = append(order, call.Name)
+		}
+	}
+	if !slices.Equal(order, []string{"alter_user_project_role", "post_webhook_event"}) {
+		t.Errorf("calls = %v, want the role change before the webhook", order)
+	}
+	select {
+	case event := <-events:
+		if event.Entity != "project" || event.Action != "updated" || event.Id == nil || *event.Id != projectId {
+			t.Errorf("event = %+v, want project.updated for project %d", event, projectId)
+		}
+	default:
+		t.Error("no project event published")
+	}
+}
+
+func TestProjectEventsCarryIds(t *testing.T) {
+	t.Setenv("REALTIME_BACKEND", "memory")
+	fake := useFakeDB(t, map[string]func([]any) (any, error){
+		"post_new_module":                 returns(11),
+		"post_new_sub_module":             returns(12),
+		"get_work_state_context":          returns(mustJSON(t, WorkStateContext{WorkId: 42, WorkName: "Login", ProjectId: 3})),
+		"get_notification_preferences_of": returns("[]"),
+		"get_email_template":              returns(nil),
+	})
+	events, unsubscribe := projectEvents.subscribe(3)
+	defer unsubscribe()
+
+	requests := []struct {
+		handler gin.HandlerFunc
+		target  string
+		body    string
+	}{
+		{postNewModule, "/postNewModule", `{"projectId":3,"moduleName":"Core"}`},
+		{postNewSubModule, "/postNewSubModule", `{"projectId":3,"subModuleName":"Auth"}`},
+		{putAlterUserWorkAssignment, "/putAlterUserWorkAssignment", `{"workId":42,"usersAdded":[5],"usersRemoved":[]}`},
+		{dropProject, "/dropProject?projectId=3", ""},
+	}
+	for _, request := range requests {
+		if recorder := serve(request.handler, http.MethodPost, request.target, strings.NewReader(request.body), nil); recorder.Code != http.StatusOK {
+			t.Fatalf("%s status = %d, body %s", request.target, recorder.Code, recorder.Body)
+		}
+	}
+	ImportResult{CreatedWorkIds: []int{70}, UpdatedWorkIds: []int{42}, BugIds: []int{71}}.publish(3)
+
+	var got []string
+	for len(events) > 0 {
+		event := <-events
+		if event.Id == nil {
+			t.Fatalf("%s.%s event has no ID", event.Entity, event.Action)
+		}
+		got = append(got, fmt.Sprintf("%s.%s:%d", event.Entity, event.Action, *event.Id))
+	}
+	want := []string{"module.created:11", "sub_module.created:12", "work.updated:42", "assignment.updated:42", "project.deleted:3",
+		"work.created:70", "work.updated:42", "bug.created:71"}
+	if !slices.Equal(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+
+	var order []string
+	for _, call := range fake.calls {
+		if call.Name == "get_work_state_context" || call.Name == "alter_user_work_assignment" {
+			order = append(order, call.Name)
+		}
+	}
+	if !slices.Equal(order, []string{"get_work_state_context", "alter_user_work_assignment"}) {
+		t.Errorf("assignment calls = %v, want the work loaded before the change", order)
+	}
+}
+
+func TestPostChatCommandUnlinkedUser(t *testing.T) {
+	t.Setenv("CHAT_SIGNING_SECRET", "")
+	t.Setenv("CHAT_COMMAND_TOKEN", "mm-token")
+	fake := useFakeDB(t, map[string]func([]any) (any, error){
+		"get_user_by_chat_id": returns(nil),
+	})
+
+	body := "team_id=T1&user_id=U9&command=%2Fpm&text=todo&token=mm-token"
+	recorder := serve(postChatCommand, http.MethodPost, "/postChatCommand", strings.NewReader(body), nil)
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "not linked") {
+		t.Fatalf("status = %d, body %s; want the not linked reply", recorder.Code, recorder.Body)
+	}
+	if calls := fake.callsTo("get_user_todo_list"); len(calls) != 0 {
+		t.Errorf("command ran for an unlinked chat account")
+	}
+}